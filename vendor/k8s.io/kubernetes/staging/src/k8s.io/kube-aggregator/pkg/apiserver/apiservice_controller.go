@@ -18,17 +18,25 @@ package apiserver
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 
+	discoveryv1 "k8s.io/api/discovery/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/kubernetes/pkg/api"
+	kubeinformers "k8s.io/kubernetes/pkg/client/informers/informers_generated/internalversion"
 	internalinformers "k8s.io/kubernetes/pkg/client/informers/informers_generated/internalversion/core/internalversion"
 	internallisters "k8s.io/kubernetes/pkg/client/listers/core/internalversion"
 
@@ -38,8 +46,25 @@ import (
 	"k8s.io/kube-aggregator/pkg/controllers"
 )
 
+// DestinationEndpoint is a single ready pod backing an APIService's Service,
+// resolved from EndpointSlices so the proxy can talk to it directly instead
+// of going through the Service's ClusterIP and kube-proxy.
+type DestinationEndpoint struct {
+	IP   string
+	Port int32
+}
+
+func (d DestinationEndpoint) String() string {
+	return fmt.Sprintf("%s:%d", d.IP, d.Port)
+}
+
 type APIHandlerManager interface {
-	AddAPIService(apiService *apiregistration.APIService, destinationHost string)
+	// proxyTransport is the cached transport to use for these destinations; it
+	// is stable across calls unless the CA bundle, InsecureSkipTLSVerify, or
+	// backing service identity changes (a change of destinations alone does
+	// not replace it), so implementations can safely reuse connection pools
+	// keyed off of it.
+	AddAPIService(apiService *apiregistration.APIService, destinations []DestinationEndpoint, proxyTransport *http.Transport)
 	RemoveAPIService(apiServiceName string)
 }
 
@@ -53,20 +78,54 @@ type APIServiceRegistrationController struct {
 	serviceLister  internallisters.ServiceLister
 	servicesSynced cache.InformerSynced
 
+	// endpointSliceLister resolves ready pod addresses for the backing
+	// Service so the proxy can load-balance across pods directly.
+	endpointSliceLister discoverylisters.EndpointSliceLister
+	endpointSliceSynced cache.InformerSynced
+
+	// transportCache memoizes the proxy transport per APIService so that
+	// repeated Service updates don't thrash connection pools.
+	transportCache *transportCache
+
+	// kubeInformers backs PreconditionAPIServices; it is only consulted if
+	// that field is non-empty.
+	kubeInformers kubeinformers.SharedInformerFactory
+
+	// serviceIndex maps a Service to the APIServices backed by it, so
+	// Service events don't require scanning every APIService.
+	serviceIndex *serviceAPIServiceIndex
+
+	// PreconditionAPIServices, if set, names APIServices whose backing
+	// Service must have at least one ready endpoint before Run() starts the
+	// worker loop. Leave nil to start immediately, which is safe outside of
+	// an HA upgrade window.
+	PreconditionAPIServices []string
+
 	// To allow injection for testing.
 	syncFn func(key string) error
 
 	queue workqueue.RateLimitingInterface
 }
 
-func NewAPIServiceRegistrationController(apiServiceInformer informers.APIServiceInformer, serviceInformer internalinformers.ServiceInformer, apiHandlerManager APIHandlerManager) *APIServiceRegistrationController {
+func NewAPIServiceRegistrationController(
+	apiServiceInformer informers.APIServiceInformer,
+	serviceInformer internalinformers.ServiceInformer,
+	endpointSliceInformer discoveryinformers.EndpointSliceInformer,
+	kubeInformers kubeinformers.SharedInformerFactory,
+	apiHandlerManager APIHandlerManager,
+) *APIServiceRegistrationController {
 	c := &APIServiceRegistrationController{
-		apiHandlerManager: apiHandlerManager,
-		apiServiceLister:  apiServiceInformer.Lister(),
-		apiServiceSynced:  apiServiceInformer.Informer().HasSynced,
-		serviceLister:     serviceInformer.Lister(),
-		servicesSynced:    serviceInformer.Informer().HasSynced,
-		queue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "APIServiceRegistrationController"),
+		apiHandlerManager:   apiHandlerManager,
+		apiServiceLister:    apiServiceInformer.Lister(),
+		apiServiceSynced:    apiServiceInformer.Informer().HasSynced,
+		serviceLister:       serviceInformer.Lister(),
+		servicesSynced:      serviceInformer.Informer().HasSynced,
+		endpointSliceLister: endpointSliceInformer.Lister(),
+		endpointSliceSynced: endpointSliceInformer.Informer().HasSynced,
+		transportCache:      newTransportCache(),
+		kubeInformers:       kubeInformers,
+		serviceIndex:        newServiceAPIServiceIndex(),
+		queue:               workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "APIServiceRegistrationController"),
 	}
 
 	apiServiceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -81,6 +140,12 @@ func NewAPIServiceRegistrationController(apiServiceInformer informers.APIService
 		DeleteFunc: c.deleteService,
 	})
 
+	endpointSliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.addEndpointSlice,
+		UpdateFunc: c.updateEndpointSlice,
+		DeleteFunc: c.deleteEndpointSlice,
+	})
+
 	c.syncFn = c.sync
 
 	return c
@@ -89,6 +154,7 @@ func NewAPIServiceRegistrationController(apiServiceInformer informers.APIService
 func (c *APIServiceRegistrationController) sync(key string) error {
 	apiService, err := c.apiServiceLister.Get(key)
 	if apierrors.IsNotFound(err) {
+		c.transportCache.remove(key)
 		c.apiHandlerManager.RemoveAPIService(key)
 		return nil
 	}
@@ -98,35 +164,132 @@ func (c *APIServiceRegistrationController) sync(key string) error {
 
 	// remove registration handling for APIServices which are not available
 	if !apiregistration.IsAPIServiceConditionTrue(apiService, apiregistration.Available) {
+		c.transportCache.remove(key)
 		c.apiHandlerManager.RemoveAPIService(key)
 		return nil
 	}
 
-	// TODO move the destination host to status so that you can see where its going
-	c.apiHandlerManager.AddAPIService(apiService, c.getDestinationHost(apiService))
+	// TODO move the destinations to status so that you can see where its going
+	destinations := c.getDestinations(apiService)
+	glog.V(4).Infof("%s destinations: %s", apiService.Name, destinationsKey(destinations))
+	proxyTransport, err := c.transportCache.getTransport(apiService.Name, apiService, c.destinationServiceUID(apiService))
+	if err != nil {
+		return err
+	}
+	c.apiHandlerManager.AddAPIService(apiService, destinations, proxyTransport)
 	return nil
 }
 
-func (c *APIServiceRegistrationController) getDestinationHost(apiService *apiregistration.APIService) string {
+// destinationsKey collapses a destination set into a single comparable
+// string for logging, independent of slice ordering. Not used as the
+// transport cache key: destinations churn far more often than the identity
+// the cache actually needs to key on (see transportCacheKey).
+func destinationsKey(destinations []DestinationEndpoint) string {
+	parts := make([]string, 0, len(destinations))
+	for _, d := range destinations {
+		parts = append(parts, d.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// destinationServiceUID returns the UID of the backing Service so the
+// transport cache can tell a recreated Service of the same name apart from
+// the one it originally built a transport for.
+func (c *APIServiceRegistrationController) destinationServiceUID(apiService *apiregistration.APIService) types.UID {
 	if apiService.Spec.Service == nil {
 		return ""
 	}
+	service, err := c.serviceLister.Services(apiService.Spec.Service.Namespace).Get(apiService.Spec.Service.Name)
+	if err != nil {
+		return ""
+	}
+	return service.UID
+}
+
+// getDestinations resolves the ready pod addresses behind an APIService's
+// backing Service via EndpointSlices, so the proxy can dial pods directly
+// and bypass kube-proxy. It falls back to the Service's ClusterIP, or its
+// DNS name, when no EndpointSlices are available yet.
+func (c *APIServiceRegistrationController) getDestinations(apiService *apiregistration.APIService) []DestinationEndpoint {
+	if apiService.Spec.Service == nil {
+		return nil
+	}
+	serviceRef := apiService.Spec.Service
+
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: serviceRef.Name})
+	slices, err := c.endpointSliceLister.EndpointSlices(serviceRef.Namespace).List(selector)
+	if err == nil {
+		var destinations []DestinationEndpoint
+		for _, slice := range slices {
+			if len(slice.Ports) == 0 {
+				continue
+			}
+			port := selectSlicePort(slice.Ports, serviceRef.Port)
+			if port == nil {
+				continue
+			}
+			for _, endpoint := range slice.Endpoints {
+				if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+					continue
+				}
+				for _, address := range endpoint.Addresses {
+					destinations = append(destinations, DestinationEndpoint{IP: address, Port: *port})
+				}
+			}
+		}
+		if len(destinations) > 0 {
+			return destinations
+		}
+	}
+
+	return []DestinationEndpoint{c.getDestinationHost(apiService)}
+}
+
+// selectSlicePort picks the EndpointSlice port matching targetPort, the
+// APIService's configured Spec.Service.Port, the same way probePort does for
+// AvailableConditionController's health check. Without a match (including a
+// nil targetPort, which means "use the Service's only port"), it falls back
+// to the first port so a multi-port Service doesn't silently drop traffic.
+func selectSlicePort(ports []discoveryv1.EndpointPort, targetPort *int32) *int32 {
+	if targetPort == nil {
+		return ports[0].Port
+	}
+	for _, p := range ports {
+		if p.Port != nil && *p.Port == *targetPort {
+			return p.Port
+		}
+	}
+	return ports[0].Port
+}
 
-	destinationHost := apiService.Spec.Service.Name + "." + apiService.Spec.Service.Namespace + ".svc"
+// getDestinationHost is the pre-EndpointSlice fallback: the Service's
+// ClusterIP for virtual-IP-backed Services, or its DNS name otherwise.
+func (c *APIServiceRegistrationController) getDestinationHost(apiService *apiregistration.APIService) DestinationEndpoint {
+	if apiService.Spec.Service == nil {
+		return DestinationEndpoint{}
+	}
+
+	port := int32(443)
+	if apiService.Spec.Service.Port != nil {
+		port = *apiService.Spec.Service.Port
+	}
+
+	dnsName := apiService.Spec.Service.Name + "." + apiService.Spec.Service.Namespace + ".svc"
 	service, err := c.serviceLister.Services(apiService.Spec.Service.Namespace).Get(apiService.Spec.Service.Name)
 	if err != nil {
-		return destinationHost
+		return DestinationEndpoint{IP: dnsName, Port: port}
 	}
 	switch {
 	// use IP from a clusterIP for these service types
 	case service.Spec.Type == api.ServiceTypeClusterIP,
 		service.Spec.Type == api.ServiceTypeNodePort,
 		service.Spec.Type == api.ServiceTypeLoadBalancer:
-		return service.Spec.ClusterIP
+		return DestinationEndpoint{IP: service.Spec.ClusterIP, Port: port}
 	}
 
 	// return the normal DNS name by default
-	return destinationHost
+	return DestinationEndpoint{IP: dnsName, Port: port}
 }
 
 func (c *APIServiceRegistrationController) Run(stopCh <-chan struct{}) {
@@ -136,17 +299,45 @@ func (c *APIServiceRegistrationController) Run(stopCh <-chan struct{}) {
 	glog.Infof("Starting APIServiceRegistrationController")
 	defer glog.Infof("Shutting down APIServiceRegistrationController")
 
-	if !controllers.WaitForCacheSync("APIServiceRegistrationController", stopCh, c.apiServiceSynced, c.servicesSynced) {
+	if !controllers.WaitForCacheSync("APIServiceRegistrationController", stopCh, c.apiServiceSynced, c.servicesSynced, c.endpointSliceSynced) {
 		return
 	}
 
+	if len(c.PreconditionAPIServices) > 0 {
+		if err := c.waitForPreconditionAPIServices(stopCh); err != nil {
+			utilruntime.HandleError(fmt.Errorf("giving up waiting for precondition APIServices: %v", err))
+			return
+		}
+	}
+
 	// only start one worker thread since its a slow moving API and the aggregation server adding bits
 	// aren't threadsafe
 	go wait.Until(c.runWorker, time.Second, stopCh)
 
+	go wait.Until(c.reconcileServiceIndex, 5*time.Minute, stopCh)
+
 	<-stopCh
 }
 
+// waitForPreconditionAPIServices blocks until every APIService named in
+// PreconditionAPIServices has a backing Service with at least one ready
+// endpoint, or stopCh closes first. Names that the APIService lister cannot
+// find are reported and left out of the wait.
+func (c *APIServiceRegistrationController) waitForPreconditionAPIServices(stopCh <-chan struct{}) error {
+	var apiServices []*apiregistration.APIService
+	for _, name := range c.PreconditionAPIServices {
+		apiService, err := c.apiServiceLister.Get(name)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("precondition APIService %q not found: %v", name, err))
+			continue
+		}
+		apiServices = append(apiServices, apiService)
+	}
+
+	glog.Infof("Waiting for endpoints of %d precondition APIServices before starting worker", len(apiServices))
+	return wait.PollImmediateUntil(time.Second, NewEndpointPrecondition(c.kubeInformers, apiServices), stopCh)
+}
+
 func (c *APIServiceRegistrationController) runWorker() {
 	for c.processNextWorkItem() {
 	}
@@ -185,12 +376,26 @@ func (c *APIServiceRegistrationController) enqueue(obj *apiregistration.APIServi
 func (c *APIServiceRegistrationController) addAPIService(obj interface{}) {
 	castObj := obj.(*apiregistration.APIService)
 	glog.V(4).Infof("Adding %s", castObj.Name)
+	if key, ok := serviceKeyFor(castObj); ok {
+		c.serviceIndex.add(key, castObj.Name)
+	}
 	c.enqueue(castObj)
 }
 
-func (c *APIServiceRegistrationController) updateAPIService(obj, _ interface{}) {
-	castObj := obj.(*apiregistration.APIService)
+func (c *APIServiceRegistrationController) updateAPIService(oldObj, newObj interface{}) {
+	oldCastObj := oldObj.(*apiregistration.APIService)
+	castObj := newObj.(*apiregistration.APIService)
 	glog.V(4).Infof("Updating %s", castObj.Name)
+
+	oldKey, oldOK := serviceKeyFor(oldCastObj)
+	newKey, newOK := serviceKeyFor(castObj)
+	if oldOK && (!newOK || oldKey != newKey) {
+		c.serviceIndex.remove(oldKey, oldCastObj.Name)
+	}
+	if newOK {
+		c.serviceIndex.add(newKey, castObj.Name)
+	}
+
 	c.enqueue(castObj)
 }
 
@@ -209,26 +414,46 @@ func (c *APIServiceRegistrationController) deleteAPIService(obj interface{}) {
 		}
 	}
 	glog.V(4).Infof("Deleting %q", castObj.Name)
+	if key, ok := serviceKeyFor(castObj); ok {
+		c.serviceIndex.remove(key, castObj.Name)
+	}
 	c.enqueue(castObj)
 }
 
-// there aren't very many apiservices, just check them all.
+// getAPIServicesFor looks up the APIServices backed by service in the
+// serviceIndex instead of scanning every APIService in the cluster.
 func (c *APIServiceRegistrationController) getAPIServicesFor(service *api.Service) []*apiregistration.APIService {
-	var ret []*apiregistration.APIService
-	apiServiceList, _ := c.apiServiceLister.List(labels.Everything())
-	for _, apiService := range apiServiceList {
-		if apiService.Spec.Service == nil {
+	return c.getAPIServicesForService(service.Namespace, service.Name)
+}
+
+func (c *APIServiceRegistrationController) getAPIServicesForService(namespace, name string) []*apiregistration.APIService {
+	names := c.serviceIndex.apiServicesFor(types.NamespacedName{Namespace: namespace, Name: name})
+	if len(names) == 0 {
+		return nil
+	}
+
+	ret := make([]*apiregistration.APIService, 0, len(names))
+	for _, apiServiceName := range names {
+		apiService, err := c.apiServiceLister.Get(apiServiceName)
+		if err != nil {
 			continue
 		}
-		if apiService.Spec.Service.Namespace == service.Namespace && apiService.Spec.Service.Name == service.Name {
-			ret = append(ret, apiService)
-		}
+		ret = append(ret, apiService)
 	}
-
 	return ret
 }
 
-// TODO, think of a way to avoid checking on every service manipulation
+// reconcileServiceIndex rebuilds the serviceIndex from the current APIService
+// list. Run periodically so the index self-heals from any add/update/delete
+// event the informer missed.
+func (c *APIServiceRegistrationController) reconcileServiceIndex() {
+	apiServices, err := c.apiServiceLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to list APIServices for service index reconciliation: %v", err))
+		return
+	}
+	c.serviceIndex.rebuild(apiServices)
+}
 
 func (c *APIServiceRegistrationController) addService(obj interface{}) {
 	for _, apiService := range c.getAPIServicesFor(obj.(*api.Service)) {
@@ -260,3 +485,47 @@ func (c *APIServiceRegistrationController) deleteService(obj interface{}) {
 		c.enqueue(apiService)
 	}
 }
+
+// apiServicesForEndpointSlice resolves the owning Service of an EndpointSlice
+// via its kubernetes.io/service-name label and returns the APIServices
+// backed by that Service for the caller to enqueue. The workqueue dedups
+// identical keys that are still waiting, so a burst of slices for the same
+// Service collapses into one queued item per key.
+func (c *APIServiceRegistrationController) apiServicesForEndpointSlice(slice *discoveryv1.EndpointSlice) []*apiregistration.APIService {
+	serviceName, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+	return c.getAPIServicesForService(slice.Namespace, serviceName)
+}
+
+func (c *APIServiceRegistrationController) addEndpointSlice(obj interface{}) {
+	for _, apiService := range c.apiServicesForEndpointSlice(obj.(*discoveryv1.EndpointSlice)) {
+		c.enqueue(apiService)
+	}
+}
+
+func (c *APIServiceRegistrationController) updateEndpointSlice(obj, _ interface{}) {
+	for _, apiService := range c.apiServicesForEndpointSlice(obj.(*discoveryv1.EndpointSlice)) {
+		c.enqueue(apiService)
+	}
+}
+
+func (c *APIServiceRegistrationController) deleteEndpointSlice(obj interface{}) {
+	castObj, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %#v", obj)
+			return
+		}
+		castObj, ok = tombstone.Obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not expected %#v", obj)
+			return
+		}
+	}
+	for _, apiService := range c.apiServicesForEndpointSlice(castObj) {
+		c.enqueue(apiService)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+func TestSelectSlicePort(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{{Port: int32ptr(443)}, {Port: int32ptr(8443)}}
+
+	tests := map[string]struct {
+		ports      []discoveryv1.EndpointPort
+		targetPort *int32
+		want       int32
+	}{
+		"nil targetPort uses the first port": {
+			ports: ports,
+			want:  443,
+		},
+		"matching targetPort is preferred over the first port": {
+			ports:      ports,
+			targetPort: int32ptr(8443),
+			want:       8443,
+		},
+		"targetPort with no match falls back to the first port": {
+			ports:      ports,
+			targetPort: int32ptr(9999),
+			want:       443,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := selectSlicePort(test.ports, test.targetPort)
+			if got == nil || *got != test.want {
+				t.Errorf("selectSlicePort() = %v, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDestinationsKeyIsOrderIndependent(t *testing.T) {
+	a := []DestinationEndpoint{{IP: "10.0.0.1", Port: 443}, {IP: "10.0.0.2", Port: 443}}
+	b := []DestinationEndpoint{{IP: "10.0.0.2", Port: 443}, {IP: "10.0.0.1", Port: 443}}
+
+	if destinationsKey(a) != destinationsKey(b) {
+		t.Errorf("destinationsKey() should be independent of slice order: %q != %q", destinationsKey(a), destinationsKey(b))
+	}
+
+	c := []DestinationEndpoint{{IP: "10.0.0.1", Port: 8443}, {IP: "10.0.0.2", Port: 443}}
+	if destinationsKey(a) == destinationsKey(c) {
+		t.Errorf("destinationsKey() should differ when a destination's port differs")
+	}
+}
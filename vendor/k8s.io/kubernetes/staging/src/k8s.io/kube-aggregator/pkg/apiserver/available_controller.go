@@ -0,0 +1,343 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/kubernetes/pkg/api"
+	internalinformers "k8s.io/kubernetes/pkg/client/informers/informers_generated/internalversion/core/internalversion"
+	internallisters "k8s.io/kubernetes/pkg/client/listers/core/internalversion"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+	informers "k8s.io/kube-aggregator/pkg/client/informers/internalversion/apiregistration/internalversion"
+	listers "k8s.io/kube-aggregator/pkg/client/listers/apiregistration/internalversion"
+	"k8s.io/kube-aggregator/pkg/controllers"
+)
+
+// availableProbeTimeout bounds a single health check dial+request so one
+// wedged endpoint can't stall the whole probe worker.
+const availableProbeTimeout = 5 * time.Second
+
+// AvailableConditionController probes the backing Service of every
+// APIService before APIServiceRegistrationController ever registers a
+// handler for it, so we never start routing to a Service that has no
+// ready pod behind it yet.
+type AvailableConditionController struct {
+	apiServiceClient apiregistration.APIServicesGetter
+
+	apiServiceLister listers.APIServiceLister
+	apiServiceSynced cache.InformerSynced
+
+	// endpointsLister resolves ready endpoints for the backing Service so we
+	// probe the actual pods rather than trusting the Available condition.
+	endpointsLister internallisters.EndpointsLister
+	endpointsSynced cache.InformerSynced
+
+	// To allow injection for testing.
+	syncFn func(key string) error
+
+	queue workqueue.RateLimitingInterface
+}
+
+func NewAvailableConditionController(
+	apiServiceInformer informers.APIServiceInformer,
+	endpointsInformer internalinformers.EndpointsInformer,
+	apiServiceClient apiregistration.APIServicesGetter,
+) *AvailableConditionController {
+	c := &AvailableConditionController{
+		apiServiceClient: apiServiceClient,
+		apiServiceLister: apiServiceInformer.Lister(),
+		apiServiceSynced: apiServiceInformer.Informer().HasSynced,
+		endpointsLister:  endpointsInformer.Lister(),
+		endpointsSynced:  endpointsInformer.Informer().HasSynced,
+		// failing probes should be retried quickly since a pod can flip to
+		// ready within seconds, but we still back off so a persistently
+		// broken backend doesn't spin the worker.
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(500*time.Millisecond, 30*time.Second),
+			"AvailableConditionController"),
+	}
+
+	apiServiceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.addAPIService,
+		UpdateFunc: c.updateAPIService,
+		DeleteFunc: c.deleteAPIService,
+	})
+
+	endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.addEndpoints,
+		UpdateFunc: c.updateEndpoints,
+		DeleteFunc: c.deleteEndpoints,
+	})
+
+	c.syncFn = c.sync
+
+	return c
+}
+
+func (c *AvailableConditionController) sync(key string) error {
+	apiService, err := c.apiServiceLister.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if apiService.Spec.Service == nil {
+		// local, non-aggregated APIServices are always available
+		return c.updateAvailableCondition(apiService, apiregistration.ConditionTrue, "Local", "Local APIServices are always available")
+	}
+
+	probeErr := c.probeService(apiService)
+	if probeErr != nil {
+		if updateErr := c.updateAvailableCondition(apiService, apiregistration.ConditionFalse, "FailedDiscoveryCheck", probeErr.Error()); updateErr != nil {
+			return updateErr
+		}
+		// let processNextWorkItem's error branch own the requeue/backoff
+		return probeErr
+	}
+
+	return c.updateAvailableCondition(apiService, apiregistration.ConditionTrue, "Passed", "all checks passed")
+}
+
+// probeService dials the ready endpoints behind the APIService's backing
+// Service in turn and returns nil as soon as one answers the discovery
+// health path with a 200; otherwise it returns the last probe error.
+func (c *AvailableConditionController) probeService(apiService *apiregistration.APIService) error {
+	serviceRef := apiService.Spec.Service
+	endpoints, err := c.endpointsLister.Endpoints(serviceRef.Namespace).Get(serviceRef.Name)
+	if err != nil {
+		return fmt.Errorf("service %s/%s has no endpoints: %v", serviceRef.Namespace, serviceRef.Name, err)
+	}
+
+	client, err := c.probeClient(apiService)
+	if err != nil {
+		return fmt.Errorf("unable to build probe client: %v", err)
+	}
+
+	healthPath := fmt.Sprintf("/apis/%s/%s", apiService.Spec.Group, apiService.Spec.Version)
+
+	var lastErr error
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Ports) == 0 {
+			continue
+		}
+		port := probePort(subset.Ports, serviceRef.Port)
+		for _, address := range subset.Addresses {
+			url := fmt.Sprintf("https://%s:%d%s", address.IP, port, healthPath)
+			resp, err := client.Get(url)
+			if err != nil {
+				lastErr = fmt.Errorf("failed to probe %s: %v", url, err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			lastErr = fmt.Errorf("probe of %s returned %d", url, resp.StatusCode)
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("service %s/%s has no ready endpoints", serviceRef.Namespace, serviceRef.Name)
+	}
+	return lastErr
+}
+
+func probePort(ports []api.EndpointPort, servicePort *int32) int32 {
+	if servicePort == nil {
+		return ports[0].Port
+	}
+	for _, p := range ports {
+		if p.Port == *servicePort || int32(p.Port) == *servicePort {
+			return p.Port
+		}
+	}
+	return ports[0].Port
+}
+
+func (c *AvailableConditionController) probeClient(apiService *apiregistration.APIService) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: apiService.Spec.InsecureSkipTLSVerify}
+	if len(apiService.Spec.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(apiService.Spec.CABundle) {
+			return nil, fmt.Errorf("unable to parse caBundle for %s", apiService.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   availableProbeTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func (c *AvailableConditionController) updateAvailableCondition(apiService *apiregistration.APIService, status apiregistration.ConditionStatus, reason, message string) error {
+	toUpdate := apiService.DeepCopy()
+	apiregistration.SetAPIServiceCondition(toUpdate, apiregistration.APIServiceCondition{
+		Type:               apiregistration.Available,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	})
+
+	if apiregistration.IsAPIServiceConditionPresentAndEqual(apiService, toUpdate, apiregistration.Available) {
+		return nil
+	}
+
+	_, err := c.apiServiceClient.APIServices().UpdateStatus(toUpdate)
+	return err
+}
+
+func (c *AvailableConditionController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	glog.Infof("Starting AvailableConditionController")
+	defer glog.Infof("Shutting down AvailableConditionController")
+
+	if !controllers.WaitForCacheSync("AvailableConditionController", stopCh, c.apiServiceSynced, c.endpointsSynced) {
+		return
+	}
+
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	<-stopCh
+}
+
+func (c *AvailableConditionController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *AvailableConditionController) processNextWorkItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncFn(key.(string))
+	if err == nil {
+		c.queue.Forget(key)
+		return true
+	}
+
+	utilruntime.HandleError(fmt.Errorf("%v failed with : %v", key, err))
+	c.queue.AddRateLimited(key)
+
+	return true
+}
+
+func (c *AvailableConditionController) enqueue(obj *apiregistration.APIService) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", obj, err)
+		return
+	}
+
+	c.queue.Add(key)
+}
+
+func (c *AvailableConditionController) addAPIService(obj interface{}) {
+	castObj := obj.(*apiregistration.APIService)
+	glog.V(4).Infof("Adding %s", castObj.Name)
+	c.enqueue(castObj)
+}
+
+func (c *AvailableConditionController) updateAPIService(obj, _ interface{}) {
+	castObj := obj.(*apiregistration.APIService)
+	glog.V(4).Infof("Updating %s", castObj.Name)
+	c.enqueue(castObj)
+}
+
+func (c *AvailableConditionController) deleteAPIService(obj interface{}) {
+	castObj, ok := obj.(*apiregistration.APIService)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %#v", obj)
+			return
+		}
+		castObj, ok = tombstone.Obj.(*apiregistration.APIService)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not expected %#v", obj)
+			return
+		}
+	}
+	glog.V(4).Infof("Deleting %q", castObj.Name)
+	c.enqueue(castObj)
+}
+
+// there aren't very many apiservices, just check them all.
+func (c *AvailableConditionController) getAPIServicesFor(endpoints *api.Endpoints) []*apiregistration.APIService {
+	var ret []*apiregistration.APIService
+	apiServiceList, _ := c.apiServiceLister.List(labels.Everything())
+	for _, apiService := range apiServiceList {
+		if apiService.Spec.Service == nil {
+			continue
+		}
+		if apiService.Spec.Service.Namespace == endpoints.Namespace && apiService.Spec.Service.Name == endpoints.Name {
+			ret = append(ret, apiService)
+		}
+	}
+
+	return ret
+}
+
+func (c *AvailableConditionController) addEndpoints(obj interface{}) {
+	for _, apiService := range c.getAPIServicesFor(obj.(*api.Endpoints)) {
+		c.enqueue(apiService)
+	}
+}
+
+func (c *AvailableConditionController) updateEndpoints(obj, _ interface{}) {
+	for _, apiService := range c.getAPIServicesFor(obj.(*api.Endpoints)) {
+		c.enqueue(apiService)
+	}
+}
+
+func (c *AvailableConditionController) deleteEndpoints(obj interface{}) {
+	castObj, ok := obj.(*api.Endpoints)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %#v", obj)
+			return
+		}
+		castObj, ok = tombstone.Obj.(*api.Endpoints)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not expected %#v", obj)
+			return
+		}
+	}
+	for _, apiService := range c.getAPIServicesFor(castObj) {
+		c.enqueue(apiService)
+	}
+}
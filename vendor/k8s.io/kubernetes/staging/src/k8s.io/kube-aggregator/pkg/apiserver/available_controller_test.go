@@ -0,0 +1,58 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func int32ptr(i int32) *int32 { return &i }
+
+func TestProbePort(t *testing.T) {
+	ports := []api.EndpointPort{{Port: 443}, {Port: 8443}}
+
+	tests := map[string]struct {
+		ports       []api.EndpointPort
+		servicePort *int32
+		want        int32
+	}{
+		"nil servicePort uses the first port": {
+			ports: ports,
+			want:  443,
+		},
+		"matching servicePort is preferred over the first port": {
+			ports:       ports,
+			servicePort: int32ptr(8443),
+			want:        8443,
+		},
+		"servicePort with no match falls back to the first port": {
+			ports:       ports,
+			servicePort: int32ptr(9999),
+			want:        443,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := probePort(test.ports, test.servicePort); got != test.want {
+				t.Errorf("probePort() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
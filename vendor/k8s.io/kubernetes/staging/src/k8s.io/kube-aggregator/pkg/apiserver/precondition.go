@@ -0,0 +1,86 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/api"
+	kubeinformers "k8s.io/kubernetes/pkg/client/informers/informers_generated/internalversion"
+	internallisters "k8s.io/kubernetes/pkg/client/listers/core/internalversion"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+// NewEndpointPrecondition returns a wait.ConditionFunc that is only satisfied
+// once every apiService's backing Service has at least one ready address.
+//
+// During an HA control plane upgrade the local apiserver can come up before
+// the aggregated backends' endpoints have repopulated; starting the worker
+// loop at that point makes the controller mass-remove handlers for
+// perfectly healthy APIServices, causing a brief storm of 503s. Gating Run()
+// on this condition keeps the existing handlers in place until the listed
+// APIServices' endpoints catch up.
+func NewEndpointPrecondition(kubeInformers kubeinformers.SharedInformerFactory, apiServices []*apiregistration.APIService) wait.ConditionFunc {
+	endpointsLister := kubeInformers.Core().InternalVersion().Endpoints().Lister()
+
+	return func() (bool, error) {
+		missing := missingReadyEndpoints(endpointsLister, apiServices)
+		if len(missing) > 0 {
+			// Missing endpoints are expected to self-heal as pods come up, so
+			// this must not be treated as a terminal error: a non-nil error
+			// here would make wait.PollImmediateUntil give up immediately
+			// instead of polling.
+			glog.V(2).Infof("Still waiting for ready endpoints for: %s", strings.Join(missing, ", "))
+			return false, nil
+		}
+		return true, nil
+	}
+}
+
+// missingReadyEndpoints returns the namespace/name of every apiService's
+// backing Service that does not yet have a ready endpoint address.
+func missingReadyEndpoints(endpointsLister internallisters.EndpointsLister, apiServices []*apiregistration.APIService) []string {
+	var missing []string
+	for _, apiService := range apiServices {
+		if apiService.Spec.Service == nil {
+			continue
+		}
+		serviceRef := apiService.Spec.Service
+
+		endpoints, err := endpointsLister.Endpoints(serviceRef.Namespace).Get(serviceRef.Name)
+		if err != nil || !endpointsHaveReadyAddress(endpoints) {
+			missing = append(missing, serviceRef.Namespace+"/"+serviceRef.Name)
+		}
+	}
+	return missing
+}
+
+func endpointsHaveReadyAddress(endpoints *api.Endpoints) bool {
+	if endpoints == nil {
+		return false
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
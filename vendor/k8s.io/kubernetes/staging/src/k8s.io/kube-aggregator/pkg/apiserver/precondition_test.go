@@ -0,0 +1,124 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/kubernetes/pkg/api"
+	internallisters "k8s.io/kubernetes/pkg/client/listers/core/internalversion"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+type fakeEndpointsLister map[string]*api.Endpoints
+
+func (f fakeEndpointsLister) List(selector labels.Selector) ([]*api.Endpoints, error) {
+	ret := make([]*api.Endpoints, 0, len(f))
+	for _, endpoints := range f {
+		ret = append(ret, endpoints)
+	}
+	return ret, nil
+}
+
+func (f fakeEndpointsLister) Endpoints(namespace string) internallisters.EndpointsNamespaceLister {
+	return fakeEndpointsNamespaceLister{namespace: namespace, endpoints: f}
+}
+
+type fakeEndpointsNamespaceLister struct {
+	namespace string
+	endpoints fakeEndpointsLister
+}
+
+func (f fakeEndpointsNamespaceLister) List(selector labels.Selector) ([]*api.Endpoints, error) {
+	var ret []*api.Endpoints
+	for _, endpoints := range f.endpoints {
+		if endpoints.Namespace == f.namespace {
+			ret = append(ret, endpoints)
+		}
+	}
+	return ret, nil
+}
+
+func (f fakeEndpointsNamespaceLister) Get(name string) (*api.Endpoints, error) {
+	endpoints, ok := f.endpoints[f.namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(api.Resource("endpoints"), name)
+	}
+	return endpoints, nil
+}
+
+func apiServiceBackedBy(namespace, name string) *apiregistration.APIService {
+	return &apiregistration.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "." + namespace},
+		Spec: apiregistration.APIServiceSpec{
+			Service: &apiregistration.ServiceReference{Namespace: namespace, Name: name},
+		},
+	}
+}
+
+func TestMissingReadyEndpoints(t *testing.T) {
+	tests := map[string]struct {
+		endpoints   fakeEndpointsLister
+		apiServices []*apiregistration.APIService
+		wantMissing sets.String
+	}{
+		"all ready": {
+			endpoints: fakeEndpointsLister{
+				"ns/svc-a": {
+					ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc-a"},
+					Subsets:    []api.EndpointSubset{{Addresses: []api.EndpointAddress{{IP: "10.0.0.1"}}}},
+				},
+			},
+			apiServices: []*apiregistration.APIService{apiServiceBackedBy("ns", "svc-a")},
+			wantMissing: sets.NewString(),
+		},
+		"endpoints object exists but has no ready addresses": {
+			endpoints: fakeEndpointsLister{
+				"ns/svc-a": {
+					ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc-a"},
+					Subsets:    []api.EndpointSubset{{NotReadyAddresses: []api.EndpointAddress{{IP: "10.0.0.1"}}}},
+				},
+			},
+			apiServices: []*apiregistration.APIService{apiServiceBackedBy("ns", "svc-a")},
+			wantMissing: sets.NewString("ns/svc-a"),
+		},
+		"endpoints object does not exist yet": {
+			endpoints:   fakeEndpointsLister{},
+			apiServices: []*apiregistration.APIService{apiServiceBackedBy("ns", "svc-a")},
+			wantMissing: sets.NewString("ns/svc-a"),
+		},
+		"local APIService without a backing Service is ignored": {
+			endpoints:   fakeEndpointsLister{},
+			apiServices: []*apiregistration.APIService{{ObjectMeta: metav1.ObjectMeta{Name: "v1."}}},
+			wantMissing: sets.NewString(),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			missing := sets.NewString(missingReadyEndpoints(test.endpoints, test.apiServices)...)
+			if !missing.Equal(test.wantMissing) {
+				t.Errorf("missingReadyEndpoints() = %v, want %v", missing.List(), test.wantMissing.List())
+			}
+		})
+	}
+}
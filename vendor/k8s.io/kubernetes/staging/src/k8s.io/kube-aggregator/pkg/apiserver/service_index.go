@@ -0,0 +1,108 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+// serviceAPIServiceIndex maps a Service to the names of the APIServices it
+// backs, so a Service add/update/delete only has to enqueue the APIServices
+// that actually reference it instead of listing and scanning every
+// APIService in the cluster.
+type serviceAPIServiceIndex struct {
+	lock  sync.RWMutex
+	index map[types.NamespacedName]sets.String
+}
+
+func newServiceAPIServiceIndex() *serviceAPIServiceIndex {
+	return &serviceAPIServiceIndex{index: map[types.NamespacedName]sets.String{}}
+}
+
+func (s *serviceAPIServiceIndex) apiServicesFor(key types.NamespacedName) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	return names.List()
+}
+
+func (s *serviceAPIServiceIndex) add(key types.NamespacedName, apiServiceName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names, ok := s.index[key]
+	if !ok {
+		names = sets.String{}
+		s.index[key] = names
+	}
+	names.Insert(apiServiceName)
+}
+
+func (s *serviceAPIServiceIndex) remove(key types.NamespacedName, apiServiceName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names, ok := s.index[key]
+	if !ok {
+		return
+	}
+	names.Delete(apiServiceName)
+	if names.Len() == 0 {
+		delete(s.index, key)
+	}
+}
+
+// rebuild replaces the index wholesale from the current list of
+// APIServices. Used by the periodic reconciliation loop to self-heal from
+// any add/update/delete event that was missed.
+func (s *serviceAPIServiceIndex) rebuild(apiServices []*apiregistration.APIService) {
+	next := map[types.NamespacedName]sets.String{}
+	for _, apiService := range apiServices {
+		if apiService.Spec.Service == nil {
+			continue
+		}
+		key := types.NamespacedName{Namespace: apiService.Spec.Service.Namespace, Name: apiService.Spec.Service.Name}
+		names, ok := next[key]
+		if !ok {
+			names = sets.String{}
+			next[key] = names
+		}
+		names.Insert(apiService.Name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.index = next
+}
+
+// serviceKeyFor returns the Service this APIService is backed by, or the
+// zero value and false if it isn't backed by a Service at all.
+func serviceKeyFor(apiService *apiregistration.APIService) (types.NamespacedName, bool) {
+	if apiService.Spec.Service == nil {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: apiService.Spec.Service.Namespace, Name: apiService.Spec.Service.Name}, true
+}
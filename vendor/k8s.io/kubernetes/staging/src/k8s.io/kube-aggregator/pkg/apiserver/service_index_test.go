@@ -0,0 +1,87 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+// TestServiceAPIServiceIndexConcurrentFlapping flaps 10k APIServices across
+// 100 Services concurrently with add/lookup/remove/rebuild, and must be run
+// with -race: it exists to catch data races in serviceAPIServiceIndex, not
+// to assert on timing.
+func TestServiceAPIServiceIndexConcurrentFlapping(t *testing.T) {
+	const (
+		numAPIServices = 10000
+		numServices    = 100
+	)
+
+	serviceKey := func(i int) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: fmt.Sprintf("svc-%d", i%numServices)}
+	}
+	apiServiceName := func(i int) string {
+		return fmt.Sprintf("v1.group%d.example.com", i)
+	}
+
+	index := newServiceAPIServiceIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numAPIServices; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := serviceKey(i)
+			name := apiServiceName(i)
+			index.add(key, name)
+			index.apiServicesFor(key)
+			index.remove(key, name)
+			index.add(key, name)
+		}()
+	}
+
+	// concurrent reconciliation, racing against the adds/removes above
+	apiServices := make([]*apiregistration.APIService, 0, numAPIServices)
+	for i := 0; i < numAPIServices; i++ {
+		key := serviceKey(i)
+		apiServices = append(apiServices, &apiregistration.APIService{
+			ObjectMeta: metav1.ObjectMeta{Name: apiServiceName(i)},
+			Spec: apiregistration.APIServiceSpec{
+				Service: &apiregistration.ServiceReference{Namespace: key.Namespace, Name: key.Name},
+			},
+		})
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		index.rebuild(apiServices)
+	}()
+
+	wg.Wait()
+
+	for i := 0; i < numServices; i++ {
+		key := types.NamespacedName{Namespace: "default", Name: fmt.Sprintf("svc-%d", i)}
+		index.apiServicesFor(key)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+// transportCacheKey identifies the inputs that actually affect the shape of
+// a *http.Transport. It deliberately excludes the resolved destination pod
+// IPs: http.Transport pools connections per-host internally, and ordinary
+// pod churn (rolling update, scale event, single-replica restart) changes
+// the destination set on practically every EndpointSlice update. Keying on
+// destinations would rebuild the transport, and drop its connection pool,
+// on every such churn instead of only when the identity of what we're
+// trusting (the backing Service, or its TLS config) actually changes.
+type transportCacheKey struct {
+	caBundleHash string
+	insecure     bool
+	serviceUID   types.UID
+}
+
+type transportCacheEntry struct {
+	key       transportCacheKey
+	transport *http.Transport
+}
+
+// transportCache memoizes the *http.Transport built for each APIService's
+// destination so that AddAPIService calls triggered by unrelated Service
+// updates reuse the existing connection pool instead of dropping in-flight
+// HTTP/2 streams to build a new one.
+type transportCache struct {
+	entries sync.Map // apiServiceName (string) -> *transportCacheEntry
+
+	hits, misses, evictions uint64
+}
+
+func newTransportCache() *transportCache {
+	return &transportCache{}
+}
+
+// getTransport returns the cached transport for apiServiceName if the CA
+// bundle and backing service identity are unchanged, and otherwise builds
+// and caches a new one. The destination pods a transport is used against can
+// change freely without invalidating it.
+func (t *transportCache) getTransport(apiServiceName string, apiService *apiregistration.APIService, serviceUID types.UID) (*http.Transport, error) {
+	key := transportCacheKey{
+		caBundleHash: hashCABundle(apiService.Spec.CABundle),
+		insecure:     apiService.Spec.InsecureSkipTLSVerify,
+		serviceUID:   serviceUID,
+	}
+
+	if existing, ok := t.entries.Load(apiServiceName); ok {
+		entry := existing.(*transportCacheEntry)
+		if entry.key == key {
+			atomic.AddUint64(&t.hits, 1)
+			return entry.transport, nil
+		}
+		atomic.AddUint64(&t.evictions, 1)
+	}
+
+	atomic.AddUint64(&t.misses, 1)
+	transport, err := buildTransport(apiService)
+	if err != nil {
+		return nil, err
+	}
+	t.entries.Store(apiServiceName, &transportCacheEntry{key: key, transport: transport})
+	return transport, nil
+}
+
+// remove evicts any cached transport for apiServiceName. Called whenever the
+// controller tells the handler manager to stop routing to an APIService.
+func (t *transportCache) remove(apiServiceName string) {
+	if _, ok := t.entries.Load(apiServiceName); ok {
+		t.entries.Delete(apiServiceName)
+		atomic.AddUint64(&t.evictions, 1)
+	}
+}
+
+func (t *transportCache) HitCount() uint64      { return atomic.LoadUint64(&t.hits) }
+func (t *transportCache) MissCount() uint64     { return atomic.LoadUint64(&t.misses) }
+func (t *transportCache) EvictionCount() uint64 { return atomic.LoadUint64(&t.evictions) }
+
+func buildTransport(apiService *apiregistration.APIService) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: apiService.Spec.InsecureSkipTLSVerify}
+	if len(apiService.Spec.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(apiService.Spec.CABundle) {
+			return nil, fmt.Errorf("unable to parse caBundle for %s", apiService.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Transport{TLSClientConfig: tlsConfig}, nil
+}
+
+func hashCABundle(caBundle []byte) string {
+	sum := sha256.Sum256(caBundle)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+func TestTransportCacheReusesUnchangedServiceIdentity(t *testing.T) {
+	cache := newTransportCache()
+	apiService := &apiregistration.APIService{}
+
+	first, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first != second {
+		t.Errorf("expected the same *http.Transport to be reused, got distinct instances")
+	}
+	if cache.HitCount() != 1 {
+		t.Errorf("HitCount() = %d, want 1", cache.HitCount())
+	}
+	if cache.MissCount() != 1 {
+		t.Errorf("MissCount() = %d, want 1", cache.MissCount())
+	}
+}
+
+// TestTransportCacheSurvivesDestinationChurn is the regression test for
+// keying the cache on destinations: ordinary pod churn (rolling update,
+// scale event, single-replica restart) must not force a new transport, or
+// every such churn would drop the connection pool this cache exists to
+// protect.
+func TestTransportCacheSurvivesDestinationChurn(t *testing.T) {
+	cache := newTransportCache()
+	apiService := &apiregistration.APIService{}
+
+	before, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A rolling update: getTransport takes no destinations, so changed pods
+	// reach it as a repeat call with the same Service UID and TLS config.
+	after, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if before != after {
+		t.Errorf("expected the transport to survive destination churn, got a rebuilt instance")
+	}
+	if cache.EvictionCount() != 0 {
+		t.Errorf("EvictionCount() = %d, want 0", cache.EvictionCount())
+	}
+}
+
+func TestTransportCacheInvalidatesOnServiceUIDChange(t *testing.T) {
+	cache := newTransportCache()
+	apiService := &apiregistration.APIService{}
+
+	first, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Service was deleted and recreated with the same name: new UID. The
+	// stale transport must not be reused.
+	second, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first == second {
+		t.Errorf("expected a fresh transport after the backing Service's UID changed")
+	}
+	if cache.EvictionCount() != 1 {
+		t.Errorf("EvictionCount() = %d, want 1", cache.EvictionCount())
+	}
+}
+
+func TestTransportCacheRemoveEvicts(t *testing.T) {
+	cache := newTransportCache()
+	apiService := &apiregistration.APIService{}
+
+	if _, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cache.remove("v1.group.example.com")
+	if cache.EvictionCount() != 1 {
+		t.Errorf("EvictionCount() = %d, want 1", cache.EvictionCount())
+	}
+
+	if _, err := cache.getTransport("v1.group.example.com", apiService, types.UID("uid-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cache.MissCount() != 2 {
+		t.Errorf("MissCount() = %d, want 2 (one before removal, one after)", cache.MissCount())
+	}
+}